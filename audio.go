@@ -0,0 +1,35 @@
+package main
+
+import "github.com/mdlayher/gosubsonic"
+
+// audioTranscode describes one on-disk representation of a Subsonic audio
+// track: its container suffix, size, and whether it's the lossless
+// original or a lossy transcode.
+type audioTranscode struct {
+	suffix   string
+	size     int64
+	lossless bool
+}
+
+// audioTranscodes returns the representations of a that subfs exposes as
+// separate files: its native suffix (lossless, at its reported size) and,
+// if Subsonic also offers a transcode of it, that as a second, lossy file.
+func audioTranscodes(a gosubsonic.Audio) []audioTranscode {
+	list := make([]audioTranscode, 0, 2)
+
+	if a.Suffix != "" {
+		list = append(list, audioTranscode{suffix: a.Suffix, size: a.Size, lossless: true})
+	}
+
+	if a.TranscodedSuffix != "" {
+		// Since we have no idea what Subsonic's transcoding settings are, we will estimate
+		// using MP3 CBR 320 as our benchmark, being that it will likely over-estimate
+		// Thanks: http://www.jeffreysward.com/editorials/mp3size.htm
+		list = append(list, audioTranscode{
+			suffix: a.TranscodedSuffix,
+			size:   ((a.DurationRaw * 320) / 8) * 1024,
+		})
+	}
+
+	return list
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/mdlayher/subfs/cache"
+)
+
+const (
+	// initialDownloadSize is fetched for the head of a file as soon as it is
+	// opened, so a player can read tags and begin playback without waiting
+	// on the full download.
+	initialDownloadSize = 128 * 1024
+
+	// minimumDownloadSize is the smallest chunk fetched for any range past
+	// the initial one, so a handful of small seeks doesn't turn into a flood
+	// of tiny requests to the Subsonic server.
+	minimumDownloadSize = 1024 * 1024
+)
+
+// blockFile is a local, partially-downloaded cache of a single Subsonic
+// file. It tracks which byte ranges have been written to disk so far, and
+// lets readers block until the range they asked for becomes available.
+type blockFile struct {
+	sub      SubFile
+	file     *os.File
+	cacheKey cache.Key
+	persist  bool
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	written   rangeSet
+	queue     chan byteRange
+	completed bool
+
+	// refs counts readers currently using this blockFile via acquire/
+	// release, and evicted marks that the disk cache has already dropped
+	// this key. file.Close is deferred until refs reaches zero while
+	// evicted, so an in-flight read is never closed out from under it by
+	// unrelated cache pressure; see evictCachedFile.
+	refs    int
+	evicted bool
+}
+
+// acquire pins b against eviction for the duration of one reader's use.
+// Every acquire must be matched by a release.
+func (b *blockFile) acquire() {
+	b.mu.Lock()
+	b.refs++
+	b.mu.Unlock()
+}
+
+// release unpins b, closing its file if it was evicted while in use and
+// this was the last active reader.
+func (b *blockFile) release() {
+	b.mu.Lock()
+	b.refs--
+	closeNow := b.refs == 0 && b.evicted
+	b.mu.Unlock()
+
+	if closeNow {
+		if err := b.file.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// blockCacheKey derives a file's disk cache key from its Subsonic ID,
+// format, and bit rate, so a lossless original and its transcoded siblings
+// never collide in the cache.
+func blockCacheKey(s SubFile) cache.Key {
+	return cache.Key{
+		ID:      s.ID,
+		Format:  s.Format,
+		BitRate: s.BitRate,
+	}
+}
+
+// fileCacheOpening tracks keys currently being opened by newBlockFile, so
+// concurrent first-reads of different files don't serialize behind each
+// other's disk I/O, while concurrent first-reads of the *same* file wait
+// for the one already in flight instead of opening it twice.
+var (
+	fileCacheOpeningMu sync.Mutex
+	fileCacheOpening   = map[cache.Key]chan struct{}{}
+)
+
+// getBlockFile returns the blockFile caching s, creating one on first
+// access.
+func getBlockFile(s SubFile) (*blockFile, error) {
+	key := blockCacheKey(s)
+
+	for {
+		fileCacheMu.Lock()
+		b, ok := fileCache[key]
+		fileCacheMu.Unlock()
+		if ok {
+			b.acquire()
+			return b, nil
+		}
+
+		fileCacheOpeningMu.Lock()
+		wait, opening := fileCacheOpening[key]
+		if opening {
+			fileCacheOpeningMu.Unlock()
+			<-wait
+			continue
+		}
+		done := make(chan struct{})
+		fileCacheOpening[key] = done
+		fileCacheOpeningMu.Unlock()
+
+		b, err := newBlockFile(s, key)
+
+		fileCacheOpeningMu.Lock()
+		delete(fileCacheOpening, key)
+		fileCacheOpeningMu.Unlock()
+		close(done)
+
+		if err != nil {
+			return nil, err
+		}
+
+		b.acquire()
+
+		fileCacheMu.Lock()
+		fileCache[key] = b
+		fileCacheMu.Unlock()
+
+		return b, nil
+	}
+}
+
+// evictCachedFile drops the blockFile (and any scrobble state) for key,
+// called when the persistent disk cache evicts it under the LRU policy.
+// Its file is only closed once every reader that already acquired it has
+// released it, so active playback is never interrupted by unrelated cache
+// pressure from other files; the disk cache has already unlinked the
+// underlying path by this point, so readers keep working against the
+// still-open, if now nameless, file.
+func evictCachedFile(key cache.Key) {
+	fileCacheMu.Lock()
+	b, ok := fileCache[key]
+	if ok {
+		delete(fileCache, key)
+	}
+	fileCacheMu.Unlock()
+
+	if ok {
+		b.mu.Lock()
+		b.evicted = true
+		closeNow := b.refs == 0
+		b.mu.Unlock()
+
+		if closeNow {
+			if err := b.file.Close(); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+	dropScrobbleState(key)
+}
+
+// newBlockFile creates a blockFile, reusing an already-downloaded copy from
+// the persistent disk cache if one exists, and otherwise backing it with a
+// fresh file (in the disk cache, or a temp directory if persistence is
+// disabled) and starting its downloader goroutine.
+func newBlockFile(s SubFile, key cache.Key) (*blockFile, error) {
+	if diskCache != nil && diskCache.Has(key) {
+		f, err := os.Open(diskCache.Path(key))
+		if err != nil {
+			return nil, err
+		}
+
+		b := &blockFile{
+			sub:       s,
+			file:      f,
+			cacheKey:  key,
+			persist:   true,
+			completed: true,
+			queue:     make(chan byteRange, 8),
+		}
+		b.cond = sync.NewCond(&b.mu)
+		b.written.add(0, s.Size)
+
+		go b.download()
+		return b, nil
+	}
+
+	var (
+		f   *os.File
+		err error
+	)
+	if diskCache != nil {
+		f, err = os.OpenFile(diskCache.Path(key), os.O_CREATE|os.O_RDWR, 0644)
+	} else {
+		f, err = ioutil.TempFile(os.TempDir(), "subfs")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	b := &blockFile{
+		sub:      s,
+		file:     f,
+		cacheKey: key,
+		persist:  diskCache != nil,
+		queue:    make(chan byteRange, 8),
+	}
+	b.cond = sync.NewCond(&b.mu)
+
+	go b.download()
+
+	// Queue the head directly, since enqueue would round it up to
+	// minimumDownloadSize.
+	head := int64(initialDownloadSize)
+	if s.Size > 0 && head > s.Size {
+		head = s.Size
+	}
+	if head > 0 {
+		b.queue <- byteRange{Start: 0, End: head}
+	}
+
+	return b, nil
+}
+
+// enqueue requests that [start, end) be downloaded, clamping to the file's
+// size and rounding short requests up to minimumDownloadSize.
+func (b *blockFile) enqueue(start, end int64) {
+	if b.sub.Size > 0 && end > b.sub.Size {
+		end = b.sub.Size
+	}
+
+	if end-start < minimumDownloadSize {
+		end = start + minimumDownloadSize
+		if b.sub.Size > 0 && end > b.sub.Size {
+			end = b.sub.Size
+		}
+	}
+
+	if end <= start {
+		return
+	}
+
+	b.queue <- byteRange{Start: start, End: end}
+}
+
+// readAt blocks until [offset, offset+size) is available in the local
+// cache, enqueueing a download of any missing parts, and returns it. It
+// returns fuse.EINTR early if intr fires first.
+func (b *blockFile) readAt(offset, size int64, intr fs.Intr) ([]byte, fuse.Error) {
+	b.mu.Lock()
+	end := offset + size
+	if b.sub.Size > 0 && end > b.sub.Size {
+		end = b.sub.Size
+	}
+
+	for _, gap := range b.written.missing(offset, end) {
+		b.enqueue(gap.Start, gap.End)
+	}
+
+	done := make(chan struct{})
+	interrupted := make(chan struct{})
+	go func() {
+		select {
+		case <-intr:
+			close(interrupted)
+			b.mu.Lock()
+			b.cond.Broadcast()
+			b.mu.Unlock()
+		case <-done:
+		}
+	}()
+
+	for !b.written.covers(offset, end) {
+		select {
+		case <-interrupted:
+			b.mu.Unlock()
+			close(done)
+			return nil, fuse.EINTR
+		default:
+		}
+
+		b.cond.Wait()
+	}
+	b.mu.Unlock()
+	close(done)
+
+	buf := make([]byte, end-offset)
+	n, err := b.file.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		log.Printf("Block cache read failed: [%d] %s: %s", b.sub.ID, b.sub.FileName, err.Error())
+		return nil, fuse.Errno(syscall.EIO)
+	}
+
+	return buf[:n], nil
+}
+
+// download is the single goroutine that serves queued byte ranges for this
+// blockFile, writing each into the local file and waking any blocked readers
+// as data becomes available.
+func (b *blockFile) download() {
+	for r := range b.queue {
+		b.mu.Lock()
+		already := b.written.covers(r.Start, r.End)
+		b.mu.Unlock()
+		if already {
+			continue
+		}
+
+		n, err := b.fetchRange(r.Start, r.End)
+		if err != nil {
+			log.Printf("Block cache download failed: [%d] %s: %s", b.sub.ID, b.sub.FileName, err.Error())
+			continue
+		}
+
+		b.mu.Lock()
+		got := r.Start + n
+		b.written.add(r.Start, got)
+		if n < r.End-r.Start {
+			// The real stream ended before our estimated Size said it
+			// would, which is the normal case for a transcode (its Size is
+			// only a rough guess based on bit rate and duration). Shrink
+			// Size to what was actually downloaded so the tail is never
+			// treated as present, and this is what's considered "complete".
+			b.sub.Size = got
+		}
+		full := b.persist && !b.completed && b.sub.Size > 0 && b.written.covers(0, b.sub.Size)
+		if full {
+			b.completed = true
+		}
+		b.cond.Broadcast()
+		b.mu.Unlock()
+
+		if full {
+			if err := diskCache.Put(b.cacheKey, b.sub.Size); err != nil {
+				log.Printf("Failed to register cache entry: [%d] %s: %s", b.sub.ID, b.sub.FileName, err.Error())
+			}
+		}
+	}
+}
+
+// fetchRange downloads [start, end) from Subsonic and writes it into the
+// local file at the matching offset, returning the number of bytes
+// actually written. This can be fewer than end-start if the real stream is
+// shorter than expected. It prefers an HTTP range request, but falls back
+// to reading (and discarding the head of) a full sequential stream for
+// servers that don't honor Range.
+func (b *blockFile) fetchRange(start, end int64) (int64, error) {
+	stream, ranged, err := b.sub.openRangeStream(start, end)
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+
+	r := bufio.NewReader(stream)
+
+	if !ranged {
+		// Server ignored our Range header and is sending the whole file
+		// from byte zero, so discard everything before start ourselves.
+		if _, err := io.CopyN(ioutil.Discard, r, start); err != nil {
+			return 0, err
+		}
+	}
+
+	buf := make([]byte, end-start)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, err
+	}
+
+	if _, err := b.file.WriteAt(buf[:n], start); err != nil {
+		return 0, err
+	}
+
+	return int64(n), nil
+}
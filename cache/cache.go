@@ -0,0 +1,214 @@
+// Package cache implements a persistent, size-bounded LRU disk cache for
+// downloaded Subsonic media files, so a warm cache survives a subfs
+// restart.
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// indexName is the sidecar file listing every entry and its last access
+// time, so the cache can be rehydrated without re-downloading anything.
+const indexName = "index.json"
+
+// indexSaveInterval bounds how often a Has() hit's last-access bump is
+// persisted to disk, so a file being read over and over doesn't serialize
+// every access behind a JSON rewrite of the whole index.
+const indexSaveInterval = 30 * time.Second
+
+// Key identifies a single cached stream: a Subsonic ID together with the
+// format and bit rate it was fetched at, since the same ID can be served as
+// several different transcodes.
+type Key struct {
+	ID      int64
+	Format  string
+	BitRate int
+}
+
+// filename returns the on-disk name for k.
+func (k Key) filename() string {
+	return fmt.Sprintf("%d-%s-%d", k.ID, k.Format, k.BitRate)
+}
+
+// entry is the persisted bookkeeping for one cached file.
+type entry struct {
+	Key        Key
+	Size       int64
+	LastAccess time.Time
+}
+
+// Cache is an LRU disk cache keyed by Key, backed by a directory of files
+// plus a JSON sidecar index that survives restarts.
+type Cache struct {
+	dir     string
+	maxSize int64
+
+	// OnEvict, if set, is called with the key of each entry removed by the
+	// LRU policy, so callers can drop their own in-memory state (an open
+	// file handle, playback tracking, and so on) for it. It is called
+	// without c.mu held.
+	OnEvict func(Key)
+
+	mu        sync.Mutex
+	entries   map[Key]*entry
+	lastSaved time.Time
+}
+
+// Open opens (creating if necessary) a disk cache rooted at dir, bounded to
+// maxSize bytes, rehydrating its index from a previous run if present.
+func Open(dir string, maxSize int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	c := &Cache{
+		dir:     dir,
+		maxSize: maxSize,
+		entries: map[Key]*entry{},
+	}
+
+	if err := c.loadIndex(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Path returns the path a file for k is, or would be, stored at.
+func (c *Cache) Path(k Key) string {
+	return filepath.Join(c.dir, k.filename())
+}
+
+// Has reports whether k is already fully present in the cache, bumping its
+// last-access time if so.
+func (c *Cache) Has(k Key) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[k]
+	if !ok {
+		return false
+	}
+
+	e.LastAccess = time.Now()
+	if time.Since(c.lastSaved) > indexSaveInterval {
+		if err := c.saveIndex(); err == nil {
+			c.lastSaved = time.Now()
+		}
+	}
+
+	return true
+}
+
+// Put registers a fully-downloaded file of the given size under k, then
+// evicts least-recently-used entries until the cache fits within maxSize.
+func (c *Cache) Put(k Key, size int64) error {
+	c.mu.Lock()
+
+	c.entries[k] = &entry{Key: k, Size: size, LastAccess: time.Now()}
+
+	evicted, err := c.evict()
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+
+	if err := c.saveIndex(); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	c.lastSaved = time.Now()
+
+	c.mu.Unlock()
+
+	if c.OnEvict != nil {
+		for _, k := range evicted {
+			c.OnEvict(k)
+		}
+	}
+
+	return nil
+}
+
+// evict removes least-recently-used entries until the cache is within
+// maxSize, returning the keys it removed. The caller must hold c.mu.
+func (c *Cache) evict() ([]Key, error) {
+	var total int64
+	list := make([]*entry, 0, len(c.entries))
+	for _, e := range c.entries {
+		list = append(list, e)
+		total += e.Size
+	}
+
+	if c.maxSize <= 0 || total <= c.maxSize {
+		return nil, nil
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].LastAccess.Before(list[j].LastAccess) })
+
+	var evicted []Key
+	for _, e := range list {
+		if total <= c.maxSize {
+			break
+		}
+
+		if err := os.Remove(c.Path(e.Key)); err != nil && !os.IsNotExist(err) {
+			return evicted, err
+		}
+
+		delete(c.entries, e.Key)
+		total -= e.Size
+		evicted = append(evicted, e.Key)
+	}
+
+	return evicted, nil
+}
+
+// loadIndex rehydrates entries from the on-disk index, dropping any whose
+// backing file no longer exists.
+func (c *Cache) loadIndex() error {
+	b, err := ioutil.ReadFile(filepath.Join(c.dir, indexName))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var entries []*entry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if _, err := os.Stat(filepath.Join(c.dir, e.Key.filename())); err != nil {
+			continue
+		}
+
+		c.entries[e.Key] = e
+	}
+
+	return nil
+}
+
+// saveIndex persists the current entries to the sidecar index. The caller
+// must hold c.mu.
+func (c *Cache) saveIndex() error {
+	entries := make([]*entry, 0, len(c.entries))
+	for _, e := range c.entries {
+		entries = append(entries, e)
+	}
+
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(c.dir, indexName), b, 0644)
+}
@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestCache(t *testing.T, maxSize int64) (*Cache, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "subfs-cache-test")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+
+	c, err := Open(dir, maxSize)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Open: %s", err)
+	}
+
+	return c, func() { os.RemoveAll(dir) }
+}
+
+func writeEntry(t *testing.T, c *Cache, k Key, size int64) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(c.Path(k), make([]byte, size), 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+}
+
+func TestCachePutAndHas(t *testing.T) {
+	c, cleanup := newTestCache(t, 1024)
+	defer cleanup()
+
+	k := Key{ID: 1, Format: "mp3", BitRate: 192}
+
+	if c.Has(k) {
+		t.Fatal("Has() = true before Put()")
+	}
+
+	writeEntry(t, c, k, 100)
+	if err := c.Put(k, 100); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+
+	if !c.Has(k) {
+		t.Fatal("Has() = false after Put()")
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c, cleanup := newTestCache(t, 150)
+	defer cleanup()
+
+	oldest := Key{ID: 1, Format: "mp3", BitRate: 192}
+	newest := Key{ID: 2, Format: "mp3", BitRate: 192}
+
+	writeEntry(t, c, oldest, 100)
+	if err := c.Put(oldest, 100); err != nil {
+		t.Fatalf("Put(oldest): %s", err)
+	}
+
+	// Ensure newest sorts after oldest by LastAccess.
+	time.Sleep(time.Millisecond)
+
+	writeEntry(t, c, newest, 100)
+	if err := c.Put(newest, 100); err != nil {
+		t.Fatalf("Put(newest): %s", err)
+	}
+
+	if c.Has(oldest) {
+		t.Fatal("Has(oldest) = true, want the LRU entry to have been evicted")
+	}
+	if !c.Has(newest) {
+		t.Fatal("Has(newest) = false, want the most recent entry to survive")
+	}
+
+	if _, err := os.Stat(c.Path(oldest)); !os.IsNotExist(err) {
+		t.Fatalf("evicted entry's file still exists on disk: err = %v", err)
+	}
+}
+
+func TestCacheEvictCallback(t *testing.T) {
+	c, cleanup := newTestCache(t, 100)
+	defer cleanup()
+
+	var evicted []Key
+	c.OnEvict = func(k Key) { evicted = append(evicted, k) }
+
+	k1 := Key{ID: 1, Format: "mp3", BitRate: 192}
+	k2 := Key{ID: 2, Format: "mp3", BitRate: 192}
+
+	writeEntry(t, c, k1, 100)
+	if err := c.Put(k1, 100); err != nil {
+		t.Fatalf("Put(k1): %s", err)
+	}
+
+	time.Sleep(time.Millisecond)
+
+	writeEntry(t, c, k2, 100)
+	if err := c.Put(k2, 100); err != nil {
+		t.Fatalf("Put(k2): %s", err)
+	}
+
+	if len(evicted) != 1 || evicted[0] != k1 {
+		t.Fatalf("OnEvict callbacks = %v, want [%v]", evicted, k1)
+	}
+}
+
+func TestCacheRehydratesFromIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "subfs-cache-test")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	k := Key{ID: 1, Format: "flac", BitRate: 0}
+
+	c, err := Open(dir, 1024)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	writeEntry(t, c, k, 200)
+	if err := c.Put(k, 200); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+
+	reopened, err := Open(dir, 1024)
+	if err != nil {
+		t.Fatalf("reopen: %s", err)
+	}
+
+	if !reopened.Has(k) {
+		t.Fatal("Has() = false after reopening an existing cache directory")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// dirCacheTTL is how long a directory's listing is kept before it is
+// re-fetched from Subsonic.
+const dirCacheTTL = 5 * time.Minute
+
+// dirListing is a single directory's cached contents: the Dirents ReadDir
+// returns, and the same entries keyed by name for Lookup.
+type dirListing struct {
+	dirents  []fuse.Dirent
+	children map[string]fs.Node
+	expires  time.Time
+}
+
+// dirCache caches directory listings keyed by RelPath, so each SubDir owns
+// its own children and files or subdirectories sharing a name in different
+// directories can never collide, unlike the process-global nameToDir and
+// nameToFile maps this replaces.
+type dirCache struct {
+	mu      sync.Mutex
+	listing map[string]*dirListing
+}
+
+// dirs is the package-wide cache of directory listings.
+var dirs = &dirCache{listing: map[string]*dirListing{}}
+
+// list returns the cached listing for d, fetching and caching a fresh one
+// from Subsonic if it's missing or has expired.
+func (c *dirCache) list(d SubDir) (*dirListing, fuse.Error) {
+	c.mu.Lock()
+	l, ok := c.listing[d.RelPath]
+	c.mu.Unlock()
+
+	if ok && time.Now().Before(l.expires) {
+		return l, nil
+	}
+
+	dirents, children, err := d.fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	l = &dirListing{
+		dirents:  dirents,
+		children: children,
+		expires:  time.Now().Add(dirCacheTTL),
+	}
+
+	c.mu.Lock()
+	c.listing[d.RelPath] = l
+	c.mu.Unlock()
+
+	return l, nil
+}
@@ -17,8 +17,13 @@ password, mount point, and cache size.
 
 `./subfs -host="demo.subsonic.org" -user="guest1" -password="guest" -mount="/tmp/subfs" -cache=1024`
 
-subfs will connect to your Subsonic media server, and cache up to `-cache` megabytes of data to your local
-machine.  The cached data will be cleared from your system's temp directory upon subfs unmount.
+subfs will connect to your Subsonic media server, and cache up to `-cache` megabytes of data in `-cache-dir`
+(by default, a "subfs" directory under your user cache directory). By default, this cache persists across
+restarts, so previously-played files don't need to be downloaded again; pass `-cache-persist=false` to use a
+temp directory that is cleared on unmount instead.
+
+Additional flags are available to cap the bit rate of transcoded audio (`-max-bitrate`) and to control
+whether playback progress is scrobbled back to Subsonic (`-scrobble`, on by default).
 
 */
 package main
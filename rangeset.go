@@ -0,0 +1,95 @@
+package main
+
+import "sort"
+
+// byteRange is a half-open interval [Start, End) of bytes within a file.
+type byteRange struct {
+	Start int64
+	End   int64
+}
+
+// rangeSet tracks a sorted set of disjoint byteRanges, used to record which
+// parts of a file have already been written to the local block cache.
+type rangeSet struct {
+	ranges []byteRange
+}
+
+// add merges [start, end) into the set, coalescing it with any ranges it
+// overlaps or touches.
+func (s *rangeSet) add(start, end int64) {
+	if end <= start {
+		return
+	}
+
+	r := byteRange{Start: start, End: end}
+	merged := make([]byteRange, 0, len(s.ranges)+1)
+
+	for _, existing := range s.ranges {
+		if existing.End < r.Start || existing.Start > r.End {
+			// No overlap and not adjacent, keep as-is.
+			merged = append(merged, existing)
+			continue
+		}
+
+		// Overlapping or touching, fold into r.
+		if existing.Start < r.Start {
+			r.Start = existing.Start
+		}
+		if existing.End > r.End {
+			r.End = existing.End
+		}
+	}
+
+	merged = append(merged, r)
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Start < merged[j].Start })
+
+	s.ranges = merged
+}
+
+// total returns the number of distinct bytes contained in the set.
+func (s *rangeSet) total() int64 {
+	var n int64
+	for _, r := range s.ranges {
+		n += r.End - r.Start
+	}
+
+	return n
+}
+
+// covers reports whether [start, end) is entirely contained within the set.
+func (s *rangeSet) covers(start, end int64) bool {
+	for _, r := range s.ranges {
+		if r.Start <= start && end <= r.End {
+			return true
+		}
+	}
+
+	return false
+}
+
+// missing returns the sub-ranges of [start, end) which are not yet present
+// in the set, in ascending order.
+func (s *rangeSet) missing(start, end int64) []byteRange {
+	gaps := make([]byteRange, 0)
+	cursor := start
+
+	for _, r := range s.ranges {
+		if r.End <= cursor || r.Start >= end {
+			continue
+		}
+
+		if r.Start > cursor {
+			gaps = append(gaps, byteRange{Start: cursor, End: r.Start})
+		}
+
+		if r.End > cursor {
+			cursor = r.End
+		}
+	}
+
+	if cursor < end {
+		gaps = append(gaps, byteRange{Start: cursor, End: end})
+	}
+
+	return gaps
+}
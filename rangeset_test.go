@@ -0,0 +1,139 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRangeSetAdd(t *testing.T) {
+	tests := []struct {
+		name string
+		adds []byteRange
+		want []byteRange
+	}{
+		{
+			name: "single range",
+			adds: []byteRange{{Start: 0, End: 10}},
+			want: []byteRange{{Start: 0, End: 10}},
+		},
+		{
+			name: "disjoint ranges stay separate",
+			adds: []byteRange{{Start: 0, End: 10}, {Start: 20, End: 30}},
+			want: []byteRange{{Start: 0, End: 10}, {Start: 20, End: 30}},
+		},
+		{
+			name: "overlapping ranges merge",
+			adds: []byteRange{{Start: 0, End: 10}, {Start: 5, End: 15}},
+			want: []byteRange{{Start: 0, End: 15}},
+		},
+		{
+			name: "adjacent ranges merge",
+			adds: []byteRange{{Start: 0, End: 10}, {Start: 10, End: 20}},
+			want: []byteRange{{Start: 0, End: 20}},
+		},
+		{
+			name: "out of order inserts still merge",
+			adds: []byteRange{{Start: 20, End: 30}, {Start: 0, End: 10}, {Start: 10, End: 20}},
+			want: []byteRange{{Start: 0, End: 30}},
+		},
+		{
+			name: "empty range is ignored",
+			adds: []byteRange{{Start: 10, End: 10}, {Start: 0, End: 5}},
+			want: []byteRange{{Start: 0, End: 5}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s rangeSet
+			for _, r := range tt.adds {
+				s.add(r.Start, r.End)
+			}
+
+			if !reflect.DeepEqual(s.ranges, tt.want) {
+				t.Errorf("add() = %v, want %v", s.ranges, tt.want)
+			}
+		})
+	}
+}
+
+func TestRangeSetCovers(t *testing.T) {
+	var s rangeSet
+	s.add(0, 10)
+	s.add(20, 30)
+
+	tests := []struct {
+		name       string
+		start, end int64
+		want       bool
+	}{
+		{"fully inside first range", 2, 8, true},
+		{"exact match", 0, 10, true},
+		{"spans the gap", 5, 25, false},
+		{"fully inside second range", 22, 28, true},
+		{"starts before first range", -1, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.covers(tt.start, tt.end); got != tt.want {
+				t.Errorf("covers(%d, %d) = %v, want %v", tt.start, tt.end, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRangeSetMissing(t *testing.T) {
+	var s rangeSet
+	s.add(10, 20)
+	s.add(30, 40)
+
+	tests := []struct {
+		name       string
+		start, end int64
+		want       []byteRange
+	}{
+		{
+			name:  "fully covered",
+			start: 10, end: 20,
+			want: []byteRange{},
+		},
+		{
+			name:  "fully missing",
+			start: 50, end: 60,
+			want: []byteRange{{Start: 50, End: 60}},
+		},
+		{
+			name:  "gap between two covered ranges",
+			start: 10, end: 40,
+			want: []byteRange{{Start: 20, End: 30}},
+		},
+		{
+			name:  "leading and trailing gaps",
+			start: 0, end: 50,
+			want: []byteRange{{Start: 0, End: 10}, {Start: 20, End: 30}, {Start: 40, End: 50}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := s.missing(tt.start, tt.end)
+			if len(got) == 0 && len(tt.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("missing(%d, %d) = %v, want %v", tt.start, tt.end, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRangeSetTotal(t *testing.T) {
+	var s rangeSet
+	s.add(0, 10)
+	s.add(20, 25)
+
+	if got, want := s.total(), int64(15); got != want {
+		t.Errorf("total() = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/mdlayher/subfs/cache"
+)
+
+// scrobbleEnabled controls whether reads trigger Subsonic scrobble calls;
+// set from the -scrobble flag.
+var scrobbleEnabled = true
+
+// scrobbleState tracks how much of a single SubFile has been read so far,
+// for the purpose of deciding when to scrobble it.
+type scrobbleState struct {
+	mu        sync.Mutex
+	read      rangeSet
+	nowPlayed bool
+	submitted bool
+}
+
+// scrobbleStates holds one scrobbleState per (ID, format, bit rate)
+// currently being tracked, so a lossless original and its transcoded
+// siblings, which are reached and read independently, don't share playback
+// progress with each other.
+var (
+	scrobbleStatesMu sync.Mutex
+	scrobbleStates   = map[cache.Key]*scrobbleState{}
+)
+
+// trackScrobble records a completed read of [offset, offset+size) against
+// s, sending Subsonic's "now playing" notification on the first read and a
+// scrobble submission once enough of the file has been read. Cover art and
+// video are never scrobbled.
+func trackScrobble(s SubFile, offset, size int64) {
+	if !scrobbleEnabled || s.IsArt || s.IsVideo || s.Size <= 0 {
+		return
+	}
+
+	key := blockCacheKey(s)
+
+	scrobbleStatesMu.Lock()
+	state, ok := scrobbleStates[key]
+	if !ok {
+		state = &scrobbleState{}
+		scrobbleStates[key] = state
+	}
+	scrobbleStatesMu.Unlock()
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if state.submitted {
+		return
+	}
+
+	if !state.nowPlayed {
+		state.nowPlayed = true
+		go scrobble(s.ID, false)
+	}
+
+	state.read.add(offset, offset+size)
+
+	if state.read.total() >= scrobbleThreshold(s) {
+		state.submitted = true
+		go scrobble(s.ID, true)
+	}
+}
+
+// scrobbleThreshold is the number of distinct bytes of s that must be read
+// before it's considered played: 50% of the file, or 4 minutes of audio at
+// its encoded bit rate, whichever is smaller. Files with no bit rate set
+// (lossless originals, and transcodes when -max-bitrate is 0) use only the
+// 50% rule.
+func scrobbleThreshold(s SubFile) int64 {
+	half := s.Size / 2
+	if s.BitRate <= 0 {
+		return half
+	}
+
+	// 4 minutes, converted from a kbps bit rate to bytes.
+	fourMinutes := int64(240) * int64(s.BitRate) * 1024 / 8
+	if fourMinutes < half {
+		return fourMinutes
+	}
+
+	return half
+}
+
+// dropScrobbleState removes the scrobble tracking state for key, e.g. when
+// its blockFile has been evicted from the cache and any future playback of
+// it should be tracked from scratch.
+func dropScrobbleState(key cache.Key) {
+	scrobbleStatesMu.Lock()
+	delete(scrobbleStates, key)
+	scrobbleStatesMu.Unlock()
+}
+
+// scrobble reports playback of id to Subsonic; submission=false is a "now
+// playing" nudge, submission=true records a completed play.
+func scrobble(id int64, submission bool) {
+	if err := subsonic.Scrobble(id, submission); err != nil {
+		log.Printf("Failed to scrobble [%d] (submission=%t): %s", id, submission, err.Error())
+	}
+}
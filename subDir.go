@@ -41,240 +41,287 @@ func (SubDir) Link(req *fuse.LinkRequest, node fs.Node, intr fs.Intr) (fs.Node,
 
 // Lookup scans the current directory for matching files or directories
 func (d SubDir) Lookup(name string, intr fs.Intr) (fs.Node, fuse.Error) {
-	// Lookup directory by name
-	if dir, ok := nameToDir[name]; ok {
-		dir.RelPath = name + "/"
-		return dir, nil
+	l, err := dirs.list(d)
+	if err != nil {
+		return nil, err
 	}
 
-	// Lookup file by name
-	if f, ok := nameToFile[name]; ok {
-		return f, nil
+	if n, ok := l.children[name]; ok {
+		return n, nil
 	}
 
-	// File not found
 	return nil, fuse.ENOENT
 }
 
+// virtualDirs are the top-level pseudo-directories layered over the
+// artist/album/track hierarchy, each handled by its own fetch branch below.
+var virtualDirs = []string{"Playlists", "Starred", "Podcasts", "Recent"}
+
+// sanitizeName replaces characters that would cause trouble in a filename
+// with an underscore.
+func sanitizeName(name string) string {
+	for _, b := range []string{"/", "\\"} {
+		name = strings.Replace(name, b, "_", -1)
+	}
+
+	return name
+}
+
 // ReadDir returns a list of directory entries depending on the current path
 func (d SubDir) ReadDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
+	l, err := dirs.list(d)
+	if err != nil {
+		return nil, err
+	}
+
+	return l.dirents, nil
+}
+
+// fetch dispatches to the appropriate Subsonic call for this directory's
+// RelPath and builds its listing.
+func (d SubDir) fetch() ([]fuse.Dirent, map[string]fs.Node, fuse.Error) {
+	switch {
+	case d.RelPath == "":
+		return d.readRoot()
+	case d.RelPath == "Playlists/":
+		return d.readPlaylists()
+	case strings.HasPrefix(d.RelPath, "Playlists/"):
+		return d.readPlaylist()
+	case d.RelPath == "Starred/":
+		return d.readStarredRoot()
+	case d.RelPath == "Starred/Artists/":
+		return d.readStarredArtists()
+	case d.RelPath == "Starred/Albums/":
+		return d.readStarredAlbums()
+	case d.RelPath == "Starred/Songs/":
+		return d.readStarredSongs()
+	case d.RelPath == "Podcasts/":
+		return d.readPodcasts()
+	case strings.HasPrefix(d.RelPath, "Podcasts/"):
+		return d.readPodcastChannel()
+	case d.RelPath == "Recent/":
+		return d.readRecent()
+	default:
+		return d.readMusicDirectory()
+	}
+}
+
+// readRoot lists the top-level artist indexes, plus the virtual
+// Playlists/Starred/Podcasts/Recent collections.
+func (d SubDir) readRoot() ([]fuse.Dirent, map[string]fs.Node, fuse.Error) {
 	// List of directory entries to return
 	directories := make([]fuse.Dirent, 0)
+	children := make(map[string]fs.Node)
 
-	// If at root of filesystem, fetch indexes
-	if d.RelPath == "" {
-		// If empty, wait for indexes to be available
-		if len(indexCache) == 0 {
-			<-indexChan
-		}
+	// If empty, wait for indexes to be available
+	if len(indexCache) == 0 {
+		<-indexChan
+	}
 
-		// Get index from cache
-		index := indexCache
-
-		// Iterate indices
-		for _, i := range index {
-			// Iterate all artists
-			for _, a := range i.Artist {
-				// Map artist's name to directory
-				nameToDir[a.Name] = SubDir{
-					ID:      a.ID,
-					RelPath: "",
-				}
-
-				// Create a directory entry
-				dir := fuse.Dirent{
-					Name: a.Name,
-					Type: fuse.DT_Dir,
-				}
-
-				// Append entry
-				directories = append(directories, dir)
+	// Get index from cache
+	index := indexCache
+
+	// Iterate indices
+	for _, i := range index {
+		// Iterate all artists
+		for _, a := range i.Artist {
+			// Map artist's name to its directory
+			children[a.Name] = SubDir{
+				ID:      a.ID,
+				RelPath: a.Name + "/",
 			}
+
+			// Create a directory entry
+			dir := fuse.Dirent{
+				Name: a.Name,
+				Type: fuse.DT_Dir,
+			}
+
+			// Append entry
+			directories = append(directories, dir)
 		}
-	} else {
-		// Get this directory's contents
-		content, err := subsonic.GetMusicDirectory(d.ID)
-		if err != nil {
-			log.Printf("Failed to retrieve directory %d: %s", d.ID, err.Error())
-			return nil, fuse.ENOENT
-		}
+	}
 
-		// Check for available cover art IDs
-		coverArt := make([]int64, 0)
+	// Add the virtual collections
+	for _, name := range virtualDirs {
+		children[name] = SubDir{RelPath: name + "/"}
+		directories = append(directories, fuse.Dirent{Name: name, Type: fuse.DT_Dir})
+	}
 
-		// Check if an ID is unique to a slice of IDs
-		unique := func(id int64, slice []int64) bool {
-			// Automatically reject ID of 0
-			if id == 0 {
-				return false
-			}
+	return directories, children, nil
+}
 
-			// Iterate the slice
-			for _, item := range slice {
-				// If there's a match, not unique
-				if id == item {
-					return false
-				}
-			}
+// readMusicDirectory lists the directories, audio, video, and cover art
+// contained in the artist or album directory identified by d.ID.
+func (d SubDir) readMusicDirectory() ([]fuse.Dirent, map[string]fs.Node, fuse.Error) {
+	// List of directory entries to return
+	directories := make([]fuse.Dirent, 0)
+	children := make(map[string]fs.Node)
 
-			// No matches, unique item
-			return true
-		}
+	// Get this directory's contents
+	content, err := subsonic.GetMusicDirectory(d.ID)
+	if err != nil {
+		log.Printf("Failed to retrieve directory %d: %s", d.ID, err.Error())
+		return nil, nil, fuse.ENOENT
+	}
 
-		// List of bad characters which should be replaced in filenames
-		badChars := []string{"/", "\\"}
+	// Check for available cover art IDs
+	coverArt := make([]int64, 0)
 
-		// Iterate all returned directories
-		for _, dir := range content.Directories {
-			// Check for any characters which may cause trouble with filesystem display
-			for _, b := range badChars {
-				dir.Title = strings.Replace(dir.Title, b, "_", -1)
-			}
+	// Check if an ID is unique to a slice of IDs
+	unique := func(id int64, slice []int64) bool {
+		// Automatically reject ID of 0
+		if id == 0 {
+			return false
+		}
 
-			// Create a directory entry
-			entry := fuse.Dirent{
-				Name: dir.Title,
-				Type: fuse.DT_Dir,
+		// Iterate the slice
+		for _, item := range slice {
+			// If there's a match, not unique
+			if id == item {
+				return false
 			}
+		}
 
-			// Add SubDir directory to lookup map
-			nameToDir[dir.Title] = SubDir{
-				ID:      dir.ID,
-				RelPath: d.RelPath + dir.Title,
-			}
+		// No matches, unique item
+		return true
+	}
 
-			// Check for cover art
-			if unique(dir.CoverArt, coverArt) {
-				coverArt = append(coverArt, dir.CoverArt)
-			}
+	// List of bad characters which should be replaced in filenames
+	badChars := []string{"/", "\\"}
 
-			// Append to list
-			directories = append(directories, entry)
+	// Iterate all returned directories
+	for _, dir := range content.Directories {
+		// Check for any characters which may cause trouble with filesystem display
+		for _, b := range badChars {
+			dir.Title = strings.Replace(dir.Title, b, "_", -1)
 		}
 
-		// Iterate all returned audio
-		for _, a := range content.Audio {
+		// Create a directory entry
+		entry := fuse.Dirent{
+			Name: dir.Title,
+			Type: fuse.DT_Dir,
+		}
 
-			// Check for lossless and lossy transcode
-			transcodes := []struct {
-				suffix string
-				size   int64
-			}{
-				{a.Suffix, a.Size},
-				{a.TranscodedSuffix, 0},
-			}
+		// Add the nested SubDir to this directory's children
+		children[dir.Title] = SubDir{
+			ID:      dir.ID,
+			RelPath: d.RelPath + dir.Title + "/",
+		}
 
-			for _, t := range transcodes {
-				// If suffix is empty (source is lossy), skip this file
-				if t.suffix == "" {
-					continue
-				}
-
-				// Mark file as lossless by default
-				lossless := true
-
-				// If size is empty (transcode to lossy), estimate it and mark as lossy
-				if t.size == 0 {
-					lossless = false
-
-					// Since we have no idea what Subsonic's transcoding settings are, we will estimate
-					// using MP3 CBR 320 as our benchmark, being that it will likely over-estimate
-					// Thanks: http://www.jeffreysward.com/editorials/mp3size.htm
-					t.size = ((a.DurationRaw * 320) / 8) * 1024
-				}
-
-				// Predefined audio filename format
-				audioFormat := fmt.Sprintf("%02d - %s - %s.%s", a.Track, a.Artist, a.Title, t.suffix)
-
-				// Check for any characters which may cause trouble with filesystem display
-				for _, b := range badChars {
-					audioFormat = strings.Replace(audioFormat, b, "_", -1)
-				}
-
-				// Create a directory entry
-				dir := fuse.Dirent{
-					Name: audioFormat,
-					Type: fuse.DT_File,
-				}
-
-				// Add SubFile file to lookup map
-				nameToFile[dir.Name] = SubFile{
-					ID:       a.ID,
-					Created:  a.Created,
-					FileName: audioFormat,
-					IsVideo:  false,
-					Lossless: lossless,
-					Size:     t.size,
-				}
-
-				// Check for cover art
-				if unique(a.CoverArt, coverArt) {
-					coverArt = append(coverArt, a.CoverArt)
-				}
-
-				// Append to list
-				directories = append(directories, dir)
-			}
+		// Check for cover art
+		if unique(dir.CoverArt, coverArt) {
+			coverArt = append(coverArt, dir.CoverArt)
 		}
 
-		// Iterate all returned video
-		for _, v := range content.Video {
-			// Predefined video filename format
-			videoFormat := fmt.Sprintf("%s.%s", v.Title, v.Suffix)
+		// Append to list
+		directories = append(directories, entry)
+	}
+
+	// Iterate all returned audio
+	for _, a := range content.Audio {
+		for _, t := range audioTranscodes(a) {
+			// Predefined audio filename format
+			audioFormat := fmt.Sprintf("%02d - %s - %s.%s", a.Track, a.Artist, a.Title, t.suffix)
 
 			// Check for any characters which may cause trouble with filesystem display
 			for _, b := range badChars {
-				videoFormat = strings.Replace(videoFormat, b, "_", -1)
+				audioFormat = strings.Replace(audioFormat, b, "_", -1)
 			}
 
 			// Create a directory entry
 			dir := fuse.Dirent{
-				Name: videoFormat,
+				Name: audioFormat,
 				Type: fuse.DT_File,
 			}
 
-			// Add SubFile file to lookup map
-			nameToFile[dir.Name] = SubFile{
-				ID:       v.ID,
-				Created:  v.Created,
-				FileName: videoFormat,
-				Size:     v.Size,
-				IsVideo:  true,
+			// Transcodes are capped at -max-bitrate; the lossless
+			// original is left uncapped
+			bitRate := 0
+			if !t.lossless {
+				bitRate = maxBitRate
+			}
+
+			// Add the SubFile to this directory's children
+			children[dir.Name] = SubFile{
+				ID:       a.ID,
+				Created:  a.Created,
+				FileName: audioFormat,
+				Format:   t.suffix,
+				BitRate:  bitRate,
+				IsVideo:  false,
+				Lossless: t.lossless,
+				Size:     t.size,
 			}
 
 			// Check for cover art
-			if unique(v.CoverArt, coverArt) {
-				coverArt = append(coverArt, v.CoverArt)
+			if unique(a.CoverArt, coverArt) {
+				coverArt = append(coverArt, a.CoverArt)
 			}
 
 			// Append to list
 			directories = append(directories, dir)
 		}
+	}
 
-		// Iterate all cover art
-		for _, c := range coverArt {
-			coverArtFormat := fmt.Sprintf("%d.jpg", c)
+	// Iterate all returned video
+	for _, v := range content.Video {
+		// Predefined video filename format
+		videoFormat := fmt.Sprintf("%s.%s", v.Title, v.Suffix)
 
-			// Create a directory entry
-			dir := fuse.Dirent{
-				Name: coverArtFormat,
-				Type: fuse.DT_File,
-			}
+		// Check for any characters which may cause trouble with filesystem display
+		for _, b := range badChars {
+			videoFormat = strings.Replace(videoFormat, b, "_", -1)
+		}
 
-			// Add SubFile file to lookup map
-			nameToFile[dir.Name] = SubFile{
-				ID:       c,
-				FileName: coverArtFormat,
-				IsArt:    true,
-			}
+		// Create a directory entry
+		dir := fuse.Dirent{
+			Name: videoFormat,
+			Type: fuse.DT_File,
+		}
 
-			// Append to list
-			directories = append(directories, dir)
+		// Add the SubFile to this directory's children
+		children[dir.Name] = SubFile{
+			ID:       v.ID,
+			Created:  v.Created,
+			FileName: videoFormat,
+			Format:   v.Suffix,
+			Size:     v.Size,
+			IsVideo:  true,
+		}
+
+		// Check for cover art
+		if unique(v.CoverArt, coverArt) {
+			coverArt = append(coverArt, v.CoverArt)
 		}
+
+		// Append to list
+		directories = append(directories, dir)
+	}
+
+	// Iterate all cover art
+	for _, c := range coverArt {
+		coverArtFormat := fmt.Sprintf("%d.jpg", c)
+
+		// Create a directory entry
+		dir := fuse.Dirent{
+			Name: coverArtFormat,
+			Type: fuse.DT_File,
+		}
+
+		// Add the SubFile to this directory's children
+		children[dir.Name] = SubFile{
+			ID:       c,
+			FileName: coverArtFormat,
+			IsArt:    true,
+		}
+
+		// Append to list
+		directories = append(directories, dir)
 	}
 
 	// Return all directory entries
-	return directories, nil
+	return directories, children, nil
 }
 
 // Mkdir does nothing, because subfs is read-only
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// readPlaylists lists the user's Subsonic playlists under /Playlists.
+func (d SubDir) readPlaylists() ([]fuse.Dirent, map[string]fs.Node, fuse.Error) {
+	directories := make([]fuse.Dirent, 0)
+	children := make(map[string]fs.Node)
+
+	playlists, err := subsonic.GetPlaylists()
+	if err != nil {
+		log.Printf("Failed to retrieve playlists: %s", err.Error())
+		return nil, nil, fuse.ENOENT
+	}
+
+	for _, p := range playlists {
+		name := sanitizeName(p.Name)
+
+		children[name] = SubDir{
+			ID:      p.ID,
+			RelPath: "Playlists/" + name + "/",
+		}
+
+		directories = append(directories, fuse.Dirent{Name: name, Type: fuse.DT_Dir})
+	}
+
+	return directories, children, nil
+}
+
+// readPlaylist lists the tracks of the playlist identified by d.ID as
+// plain files, reusing the streaming pipeline used for regular tracks.
+func (d SubDir) readPlaylist() ([]fuse.Dirent, map[string]fs.Node, fuse.Error) {
+	directories := make([]fuse.Dirent, 0)
+	children := make(map[string]fs.Node)
+
+	playlist, err := subsonic.GetPlaylist(d.ID)
+	if err != nil {
+		log.Printf("Failed to retrieve playlist %d: %s", d.ID, err.Error())
+		return nil, nil, fuse.ENOENT
+	}
+
+	for _, e := range playlist.Entry {
+		for _, t := range audioTranscodes(e) {
+			name := sanitizeName(fmt.Sprintf("%02d - %s - %s.%s", e.Track, e.Artist, e.Title, t.suffix))
+
+			bitRate := 0
+			if !t.lossless {
+				bitRate = maxBitRate
+			}
+
+			children[name] = SubFile{
+				ID:       e.ID,
+				Created:  e.Created,
+				FileName: name,
+				Format:   t.suffix,
+				BitRate:  bitRate,
+				Lossless: t.lossless,
+				Size:     t.size,
+			}
+
+			directories = append(directories, fuse.Dirent{Name: name, Type: fuse.DT_File})
+		}
+	}
+
+	return directories, children, nil
+}
+
+// readStarredRoot lists the Artists/Albums/Songs collections under
+// /Starred.
+func (d SubDir) readStarredRoot() ([]fuse.Dirent, map[string]fs.Node, fuse.Error) {
+	directories := make([]fuse.Dirent, 0)
+	children := make(map[string]fs.Node)
+
+	for _, name := range []string{"Artists", "Albums", "Songs"} {
+		children[name] = SubDir{RelPath: "Starred/" + name + "/"}
+		directories = append(directories, fuse.Dirent{Name: name, Type: fuse.DT_Dir})
+	}
+
+	return directories, children, nil
+}
+
+// readStarredArtists lists starred artists, browsable the same way as a
+// regular artist directory.
+func (d SubDir) readStarredArtists() ([]fuse.Dirent, map[string]fs.Node, fuse.Error) {
+	directories := make([]fuse.Dirent, 0)
+	children := make(map[string]fs.Node)
+
+	starred, err := subsonic.GetStarred()
+	if err != nil {
+		log.Printf("Failed to retrieve starred items: %s", err.Error())
+		return nil, nil, fuse.ENOENT
+	}
+
+	for _, a := range starred.Artist {
+		name := sanitizeName(a.Name)
+		children[name] = SubDir{ID: a.ID, RelPath: "Starred/Artists/" + name + "/"}
+		directories = append(directories, fuse.Dirent{Name: name, Type: fuse.DT_Dir})
+	}
+
+	return directories, children, nil
+}
+
+// readStarredAlbums lists starred albums, browsable the same way as a
+// regular album directory.
+func (d SubDir) readStarredAlbums() ([]fuse.Dirent, map[string]fs.Node, fuse.Error) {
+	directories := make([]fuse.Dirent, 0)
+	children := make(map[string]fs.Node)
+
+	starred, err := subsonic.GetStarred()
+	if err != nil {
+		log.Printf("Failed to retrieve starred items: %s", err.Error())
+		return nil, nil, fuse.ENOENT
+	}
+
+	for _, al := range starred.Album {
+		name := sanitizeName(al.Title)
+		children[name] = SubDir{ID: al.ID, RelPath: "Starred/Albums/" + name + "/"}
+		directories = append(directories, fuse.Dirent{Name: name, Type: fuse.DT_Dir})
+	}
+
+	return directories, children, nil
+}
+
+// readStarredSongs lists starred songs as plain files.
+func (d SubDir) readStarredSongs() ([]fuse.Dirent, map[string]fs.Node, fuse.Error) {
+	directories := make([]fuse.Dirent, 0)
+	children := make(map[string]fs.Node)
+
+	starred, err := subsonic.GetStarred()
+	if err != nil {
+		log.Printf("Failed to retrieve starred items: %s", err.Error())
+		return nil, nil, fuse.ENOENT
+	}
+
+	for _, s := range starred.Song {
+		for _, t := range audioTranscodes(s) {
+			name := sanitizeName(fmt.Sprintf("%02d - %s - %s.%s", s.Track, s.Artist, s.Title, t.suffix))
+
+			bitRate := 0
+			if !t.lossless {
+				bitRate = maxBitRate
+			}
+
+			children[name] = SubFile{
+				ID:       s.ID,
+				Created:  s.Created,
+				FileName: name,
+				Format:   t.suffix,
+				BitRate:  bitRate,
+				Lossless: t.lossless,
+				Size:     t.size,
+			}
+
+			directories = append(directories, fuse.Dirent{Name: name, Type: fuse.DT_File})
+		}
+	}
+
+	return directories, children, nil
+}
+
+// readPodcasts lists podcast channels under /Podcasts.
+func (d SubDir) readPodcasts() ([]fuse.Dirent, map[string]fs.Node, fuse.Error) {
+	directories := make([]fuse.Dirent, 0)
+	children := make(map[string]fs.Node)
+
+	channels, err := subsonic.GetPodcasts()
+	if err != nil {
+		log.Printf("Failed to retrieve podcasts: %s", err.Error())
+		return nil, nil, fuse.ENOENT
+	}
+
+	for _, ch := range channels {
+		name := sanitizeName(ch.Title)
+
+		children[name] = SubDir{
+			ID:      ch.ID,
+			RelPath: "Podcasts/" + name + "/",
+		}
+
+		directories = append(directories, fuse.Dirent{Name: name, Type: fuse.DT_Dir})
+	}
+
+	return directories, children, nil
+}
+
+// readPodcastChannel lists the episodes of the podcast channel identified
+// by d.ID as plain files.
+func (d SubDir) readPodcastChannel() ([]fuse.Dirent, map[string]fs.Node, fuse.Error) {
+	directories := make([]fuse.Dirent, 0)
+	children := make(map[string]fs.Node)
+
+	channels, err := subsonic.GetPodcasts()
+	if err != nil {
+		log.Printf("Failed to retrieve podcasts: %s", err.Error())
+		return nil, nil, fuse.ENOENT
+	}
+
+	for _, ch := range channels {
+		if ch.ID != d.ID {
+			continue
+		}
+
+		for _, e := range ch.Episode {
+			name := sanitizeName(fmt.Sprintf("%s.%s", e.Title, e.Suffix))
+
+			// Podcasts come back from Subsonic in a single format, with no
+			// separate lossless/transcode pair to choose between, so
+			// they're requested like video: through the capped transcode
+			// path rather than assumed to be a raw, uncapped download.
+			children[name] = SubFile{
+				ID:       e.ID,
+				Created:  e.Created,
+				FileName: name,
+				Format:   e.Suffix,
+				BitRate:  maxBitRate,
+				Size:     e.Size,
+			}
+
+			directories = append(directories, fuse.Dirent{Name: name, Type: fuse.DT_File})
+		}
+	}
+
+	return directories, children, nil
+}
+
+// readRecent lists recently-added albums under /Recent, browsable the same
+// way as a regular album directory.
+func (d SubDir) readRecent() ([]fuse.Dirent, map[string]fs.Node, fuse.Error) {
+	directories := make([]fuse.Dirent, 0)
+	children := make(map[string]fs.Node)
+
+	albums, err := subsonic.GetAlbumList2("newest", 50, 0)
+	if err != nil {
+		log.Printf("Failed to retrieve recently-added albums: %s", err.Error())
+		return nil, nil, fuse.ENOENT
+	}
+
+	for _, al := range albums {
+		name := sanitizeName(al.Title)
+		children[name] = SubDir{ID: al.ID, RelPath: "Recent/" + name + "/"}
+		directories = append(directories, fuse.Dirent{Name: name, Type: fuse.DT_Dir})
+	}
+
+	return directories, children, nil
+}
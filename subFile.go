@@ -1,13 +1,14 @@
 package main
 
 import (
-	"bufio"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"os"
+	"net/http"
+	"net/url"
 	"strings"
-	"sync/atomic"
+	"syscall"
 	"time"
 
 	"bazil.org/fuse"
@@ -20,6 +21,8 @@ type SubFile struct {
 	ID       int64
 	Created  time.Time
 	FileName string
+	Format   string
+	BitRate  int
 	IsArt    bool
 	IsVideo  bool
 	Lossless bool
@@ -35,199 +38,59 @@ func (s SubFile) Attr() fuse.Attr {
 	}
 }
 
-// Read opens a file stream from Subsonic, caches the stream as appropriate, and returns the
-// resulting bytes needed with an offset and size applied
+// Read services a FUSE read request. Audio and video are served from this
+// file's blockFile, which downloads only the byte ranges actually being
+// read; cover art is small enough that it is simply fetched in full.
 func (s SubFile) Read(req *fuse.ReadRequest, res *fuse.ReadResponse, intr fs.Intr) fuse.Error {
-	// Byte stream to return data
-	byteChan := make(chan []byte)
-
-	// Fetch the file
-	go s.fetchFile(req, byteChan)
-
-	// Wait for an event on read
-	select {
-	// Byte stream channel
-	case stream := <-byteChan:
-		res.Data = stream
-		//close(byteChan)
-		return nil
-	// Interrupt channel
-	case <-intr:
-		return fuse.EINTR
-	}
-}
-
-// fetchFile invokes a file download request, and returns the subsequent cached stream
-// for all other clients
-func (s SubFile) fetchFile(req *fuse.ReadRequest, byteChan chan []byte) {
-	// Check for file in cache
-	if cFile, ok := fileCache[s.ID]; ok {
-		// Make a buffer equal the requested size
-		buf := make([]byte, req.Size)
-
-		for {
-			// Read the file at the specified offset into the buffer
-			n, err := cFile.ReadAt(buf, req.Offset)
-
-			// If bytes returned and no error or EOF detected, we got stream, so return it
-			if err == nil || err == io.EOF {
-				byteChan <- buf
-				return
-			} else if n == 0 && strings.Contains(err.Error(), "no such file or directory") {
-				// File was removed from the cache, so purge it
-				log.Printf("Cache missing: [%d] %s", s.ID, s.FileName)
-				delete(fileCache, s.ID)
-				cacheTotal = atomic.AddInt64(&cacheTotal, -1*s.Size)
-
-				// Print some cache metrics
-				cacheUse := float64(cacheTotal) / 1024 / 1024
-				cacheDel := float64(s.Size) / 1024 / 1024
-				log.Printf("Cache use: %0.3f / %d.000 MB (-%0.3f MB)", cacheUse, *cacheSize, cacheDel)
-
-				// Close file handle
-				if err := cFile.Close(); err != nil {
-					log.Println(err)
-				}
-
-				// Break loop to begin re-opening stream
-				break
-			} else {
-				// Some other condition occurred, so log it
-				log.Println(err)
-				<-time.After(1 * time.Second)
-			}
-		}
+	if s.IsArt {
+		return s.readArt(req, res)
 	}
 
-	// Open stream
-	stream, err := s.openStream()
+	b, err := getBlockFile(s)
 	if err != nil {
 		log.Println(err)
-		byteChan <- nil
-		return
+		return fuse.Errno(syscall.EIO)
 	}
+	defer b.release()
 
-	// Generate a temporary file
-	tmpFile, err := ioutil.TempFile(os.TempDir(), "subfs")
-	if err != nil {
-		log.Println(err)
-		return
+	data, ferr := b.readAt(req.Offset, int64(req.Size), intr)
+	if ferr != nil {
+		return ferr
 	}
 
-	// Add file to cache map
-	fileCache[s.ID] = *tmpFile
-
-	// Invoke a recursive goroutine to wait for this file to be ready
-	go s.fetchFile(req, byteChan)
-
-	// Track total download size, for progress reporting
-	var total int64
-	atomic.StoreInt64(&total, 0)
+	trackScrobble(s, req.Offset, int64(len(data)))
 
-	// Stop on file completion
-	stopProgressChan := make(chan bool)
-	go func() {
-		// Print progress every second
-		progress := time.NewTicker(1 * time.Second)
-
-		// Calculate total file size
-		totalSize := float64(s.Size)/1024/1024
-
-		for {
-			select {
-			// Print progress
-			case <-progress.C:
-				// Capture current progress
-				currTotal := atomic.LoadInt64(&total)
-				current := float64(currTotal)/1024/1024
-
-				// Capture current percentage
-				percent := int64(float64(float64(total) / float64(s.Size)) * 100)
-
-				log.Printf("[%d] [%03d%%] %0.3f / %0.3f MB", s.ID, percent, current, totalSize)
-			// Stop printing
-			case <-stopProgressChan:
-				return
-			}
-		}
-	}()
-
-	// Read in the stream, dumping it to a temporary file as we go
-	streamBuf := bufio.NewReader(stream)
-	for {
-		// Read one buffer from the stream
-		buf := make([]byte, 8192)
-		x, err := streamBuf.Read(buf)
-		if x == 0 || err != nil {
-			if err != io.EOF {
-				log.Println(err)
-			}
-
-			// Store file size
-			s.Size = atomic.LoadInt64(&total)
-
-			break
-		}
-
-		atomic.AddInt64(&total, int64(x))
+	res.Data = data
+	return nil
+}
 
-		// Write to the file
-		y, err := tmpFile.Write(buf[:x])
-		if y == 0 || err != nil {
-			log.Println(err)
-			break
-		}
+// readArt downloads cover art in full and returns the requested slice.
+// Art is small enough that range tracking isn't worth the complexity.
+func (s SubFile) readArt(req *fuse.ReadRequest, res *fuse.ReadResponse) fuse.Error {
+	stream, err := s.openStream()
+	if err != nil {
+		log.Println(err)
+		return fuse.Errno(syscall.EIO)
 	}
+	defer stream.Close()
 
-	// Stop progress reporting
-	stopProgressChan <- true
-
-	// Close stream
-	log.Printf("Closing stream: [%d] %s", s.ID, s.FileName)
-	if err := stream.Close(); err != nil {
+	data, err := ioutil.ReadAll(stream)
+	if err != nil {
 		log.Println(err)
-		return
+		return fuse.Errno(syscall.EIO)
 	}
 
-	// Cache conditions
-	// Check for maximum cache size
-	cacheOne := cacheTotal > *cacheSize*1024*1024
-	// Check if cache will overflow if file is added
-	cacheTwo := cacheTotal+s.Size > *cacheSize*1024*1024
-	// If file is greater than 50MB, skip caching to conserve memory
-	threshold := 50
-	cacheThree := s.Size > int64(threshold*1024*1024)
-
-	// Print messages for failure conditions
-	if cacheOne {
-		log.Printf("Cache full (%d MB), skipping local cache", *cacheSize)
-	} else if cacheTwo {
-		log.Printf("File will overflow cache (%0.3f MB), skipping local cache", float64(s.Size)/1024/1024)
-	} else if cacheThree {
-		log.Printf("File too large (%0.3f > %0d MB), skipping local cache", float64(s.Size)/1024/1024, threshold)
+	start := req.Offset
+	if start > int64(len(data)) {
+		start = int64(len(data))
 	}
-
-	// Check for ANY failure conditions, delete file if so
-	if cacheOne || cacheTwo || cacheThree {
-		// Close file
-		if err := tmpFile.Close(); err != nil {
-			log.Println(err)
-		}
-
-		// Remove file
-		if err := os.Remove(tmpFile.Name()); err != nil {
-			log.Println(err)
-		}
-		return
+	end := start + int64(req.Size)
+	if end > int64(len(data)) {
+		end = int64(len(data))
 	}
 
-	// Add file's size to cache total size
-	cacheTotal = atomic.AddInt64(&cacheTotal, s.Size)
-
-	// Print some cache metrics
-	cacheUse := float64(cacheTotal) / 1024 / 1024
-	cacheAdd := float64(s.Size) / 1024 / 1024
-	log.Printf("Cache use: %0.3f / %d.000 MB (+%0.3f MB)", cacheUse, *cacheSize, cacheAdd)
+	res.Data = data[start:end]
+	return nil
 }
 
 // openStream returns the appropriate io.ReadCloser from a SubFile
@@ -249,7 +112,7 @@ func (s SubFile) openStream() (io.ReadCloser, error) {
 		if strings.Contains(err.Error(), "not authorized to download files") {
 			// Stream a transcoded file instead
 			log.Printf("Opening transcoded audio stream: [%d] %s", s.ID, s.FileName)
-			return subsonic.Stream(s.ID, nil)
+			return subsonic.Stream(s.ID, &gosubsonic.StreamOptions{MaxBitRate: s.BitRate})
 		}
 
 		// Attempt to get media file in raw, non-transcoded form
@@ -257,20 +120,87 @@ func (s SubFile) openStream() (io.ReadCloser, error) {
 		return stream, nil
 	}
 
-	// Stream options, for extra options
-	var streamOptions gosubsonic.StreamOptions
+	// Stream options, honoring the requested transcode format and bit rate
+	streamOptions := gosubsonic.StreamOptions{
+		Format:     s.Format,
+		MaxBitRate: s.BitRate,
+	}
 	if s.IsVideo {
 		// Item is video
-		streamOptions = gosubsonic.StreamOptions{
-			Size: "1280x720",
-		}
+		streamOptions.Size = "1280x720"
 
 		log.Printf("Opening video stream: [%d] %s [%s]", s.ID, s.FileName, streamOptions.Size)
 	} else {
 		// Item is audio
-		log.Printf("Opening transcoded audio stream: [%d] %s", s.ID, s.FileName)
+		log.Printf("Opening transcoded audio stream: [%d] %s [%s @ %d kbps]", s.ID, s.FileName, s.Format, s.BitRate)
 	}
 
 	// Get media file stream
 	return subsonic.Stream(s.ID, &streamOptions)
 }
+
+// openRangeStream attempts to fetch [start, end) directly from Subsonic via
+// an HTTP Range request, reporting whether the server honored it. Servers
+// that ignore Range respond with the full file from byte zero instead; the
+// caller is responsible for discarding everything before start in that case.
+func (s SubFile) openRangeStream(start, end int64) (io.ReadCloser, bool, error) {
+	streamURL := s.streamURL()
+	if streamURL == "" {
+		stream, err := s.openStream()
+		return stream, false, err
+	}
+
+	req, err := http.NewRequest("GET", streamURL, nil)
+	if err != nil {
+		stream, serr := s.openStream()
+		return stream, false, serr
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("Range request failed, falling back to sequential stream: [%d] %s: %s", s.ID, s.FileName, err.Error())
+		stream, serr := s.openStream()
+		return stream, false, serr
+	}
+
+	if res.StatusCode == http.StatusPartialContent {
+		return res.Body, true, nil
+	}
+
+	// Server doesn't honor Range and is streaming the whole file.
+	return res.Body, false, nil
+}
+
+// streamURL builds the raw Subsonic REST URL used for range requests,
+// bypassing gosubsonic since it has no notion of partial downloads. It
+// requests the same representation openStream would: the untranscoded
+// original for lossless audio, otherwise s.Format capped at s.BitRate.
+func (s SubFile) streamURL() string {
+	if s.IsArt || subsonicHost == "" {
+		return ""
+	}
+
+	v := url.Values{}
+	v.Set("id", fmt.Sprintf("%d", s.ID))
+	v.Set("u", subsonicUser)
+	v.Set("p", subsonicPassword)
+	v.Set("v", "1.15.0")
+	v.Set("c", "subfs")
+
+	if !s.IsVideo && s.Lossless {
+		v.Set("format", "raw")
+	} else {
+		if s.Format != "" {
+			v.Set("format", s.Format)
+		}
+		if s.BitRate > 0 {
+			v.Set("maxBitRate", fmt.Sprintf("%d", s.BitRate))
+		}
+		if s.IsVideo {
+			v.Set("size", "1280x720")
+		}
+	}
+
+	return fmt.Sprintf("%s/rest/stream.view?%s", strings.TrimRight(subsonicHost, "/"), v.Encode())
+}
@@ -5,28 +5,44 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
 	"github.com/mdlayher/gosubsonic"
+	"github.com/mdlayher/subfs/cache"
 )
 
 // subsonic stores the instance of the gosubsonic client
 var subsonic gosubsonic.Client
 
-// nameToDir maps a directory name to its SubDir
-var nameToDir map[string]SubDir
+// subsonicHost, subsonicUser, and subsonicPassword mirror the connection
+// flags, kept at package scope so SubFile can build raw Subsonic REST URLs
+// for range requests without going through gosubsonic.
+var (
+	subsonicHost     string
+	subsonicUser     string
+	subsonicPassword string
+)
+
+// fileCache maps a composite (ID, format, bit rate) key to the blockFile
+// caching it locally, so a lossless original and its transcodes don't
+// collide with each other
+var fileCache map[cache.Key]*blockFile
 
-// nameToFile maps a file name to its SubFile
-var nameToFile map[string]SubFile
+// fileCacheMu guards fileCache
+var fileCacheMu sync.Mutex
 
-// fileCache maps a file name to its file pointer
-var fileCache map[string]os.File
+// diskCache is the persistent LRU disk cache backing fileCache, or nil when
+// -cache-persist=false restores the old temp-directory behavior.
+var diskCache *cache.Cache
 
-// cacheTotal is the total size of local files in the cache
-var cacheTotal int64
+// maxBitRate caps the bit rate Subsonic transcodes audio down to; 0 leaves
+// the decision to the server. It has no effect on lossless downloads.
+var maxBitRate int
 
 // indexCache stores the fetched indexes temporarily
 var indexCache []gosubsonic.Index
@@ -34,12 +50,6 @@ var indexCache []gosubsonic.Index
 // indexChan blocks subfs from getting indexes until the cache is populated
 var indexChan chan bool
 
-// streamMap maps a fileID to a channel containing a file stream
-var streamMap map[int64]chan []byte
-
-// cacheSize is the maximum size of the local file cache in megabytes
-var cacheSize = flag.Int64("cache", 100, "Size of the local file cache, in megabytes")
-
 func main() {
 	// Flags to connect to Subsonic server
 	host := flag.String("host", "", "Host of Subsonic server")
@@ -49,6 +59,17 @@ func main() {
 	// Flag for subfs mount point
 	mount := flag.String("mount", "", "Path where subfs will be mounted")
 
+	// Flags for the local file cache
+	cacheDir := flag.String("cache-dir", defaultCacheDir(), "Directory used for the persistent local file cache")
+	cacheSize := flag.Int64("cache", 1024, "Maximum size of the local file cache, in megabytes")
+	cachePersist := flag.Bool("cache-persist", true, "Persist the local file cache to -cache-dir across restarts; if false, a temp directory is used and cleared on exit")
+
+	// Flag to cap transcoded audio bit rate
+	maxBitRateFlag := flag.Int("max-bitrate", 0, "Maximum bit rate in kbps for transcoded audio, or 0 for no limit")
+
+	// Flag to enable scrobbling playback progress back to Subsonic
+	scrobble := flag.Bool("scrobble", true, "Scrobble playback progress back to Subsonic")
+
 	// Parse command line flags
 	flag.Parse()
 
@@ -60,23 +81,34 @@ func main() {
 
 	// Store subsonic client for global use
 	subsonic = *sub
-
-	// Initialize lookup maps
-	nameToDir = map[string]SubDir{}
-	nameToFile = map[string]SubFile{}
+	subsonicHost = *host
+	subsonicUser = *user
+	subsonicPassword = *password
+	maxBitRate = *maxBitRateFlag
+	scrobbleEnabled = *scrobble
 
 	// Initialize file cache
-	fileCache = map[string]os.File{}
-	cacheTotal = 0
+	fileCache = map[cache.Key]*blockFile{}
+
+	// Open the persistent disk cache, unless persistence was disabled
+	if *cachePersist {
+		dc, err := cache.Open(*cacheDir, *cacheSize*1024*1024)
+		if err != nil {
+			log.Fatalf("Could not open local file cache: %s", err.Error())
+		}
+
+		dc.OnEvict = evictCachedFile
+		diskCache = dc
+		log.Printf("subfs: caching up to %d MB in %s", *cacheSize, *cacheDir)
+	} else {
+		log.Printf("subfs: local file cache persistence disabled, using a temp directory")
+	}
 
 	// Initialize index cache
 	indexCache = make([]gosubsonic.Index, 0)
 	indexChan = make(chan bool, 0)
 	go cacheIndexes()
 
-	// Initialize stream map
-	streamMap = map[int64]chan []byte{}
-
 	// Attempt to mount filesystem
 	c, err := fuse.Mount(*mount)
 	if err != nil {
@@ -84,7 +116,7 @@ func main() {
 	}
 
 	// Serve the FUSE filesystem
-	log.Printf("subfs: %s@%s -> %s [cache: %d MB]", *user, *host, *mount, *cacheSize)
+	log.Printf("subfs: %s@%s -> %s", *user, *host, *mount)
 	go func() {
 		if err := fs.Serve(c, SubFS{}); err != nil {
 			log.Fatalf("Could not serve subfs at %s: %s", *mount, err.Error())
@@ -100,20 +132,23 @@ func main() {
 		break
 	}
 
-	// Purge all cached files
-	for _, f := range fileCache {
-		// Close file
-		if err := f.Close(); err != nil {
+	// Close all cached files, removing them only if they aren't part of the
+	// persistent disk cache
+	fileCacheMu.Lock()
+	for _, b := range fileCache {
+		if err := b.file.Close(); err != nil {
 			log.Println(err)
 		}
 
-		// Remove file
-		if err := os.Remove(f.Name()); err != nil {
-			log.Println(err)
+		if !b.persist {
+			if err := os.Remove(b.file.Name()); err != nil {
+				log.Println(err)
+			}
 		}
 	}
 
-	log.Printf("subfs: removed %d cached file(s)", len(fileCache))
+	log.Printf("subfs: closed %d cached file(s)", len(fileCache))
+	fileCacheMu.Unlock()
 
 	// Attempt to unmount the FUSE filesystem
 	retry := 3
@@ -167,6 +202,17 @@ func cacheIndexes() {
 	}
 }
 
+// defaultCacheDir returns the default location for the persistent local
+// file cache, under the current user's home directory.
+func defaultCacheDir() string {
+	home := os.Getenv("HOME")
+	if home == "" {
+		return filepath.Join(os.TempDir(), "subfs")
+	}
+
+	return filepath.Join(home, ".cache", "subfs")
+}
+
 // SubFS represents the root of the filesystem
 type SubFS struct{}
 